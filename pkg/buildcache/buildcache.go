@@ -0,0 +1,303 @@
+package buildcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CacheImageRef is the well-known image darch uses to persist cache entries
+// as labels. Keeping them on an image (rather than, say, a file on disk)
+// means they survive restarts and participate in containerd's
+// content-addressable garbage collection via the containerd.io/gc.ref.content.*
+// labels we attach alongside them.
+const CacheImageRef = "refs/darch/cache"
+
+const labelPrefix = "darch.io/buildcache."
+
+// annotationKey/annotationEntry are OCI manifest annotations, not
+// containerd image labels: labels are local metadata that never leaves
+// this daemon, but annotations are part of the manifest itself and survive
+// push/pull. Embedding the cache entry there is what lets `--cache-from`
+// actually work against an image built on a different host.
+const annotationKey = labelPrefix + "key"
+const annotationEntry = labelPrefix + "entry"
+
+// Key identifies a single cached build result.
+type Key string
+
+// ComputeKey derives a cache key from everything that can change the output
+// of a recipe build: the parent image it inherits from, the contents of the
+// recipe directory, the recipe name/tag, and the environment passed to the
+// build containers.
+func ComputeKey(parent digest.Digest, recipeDir digest.Digest, recipeName string, tag string, env []string) Key {
+	return Key(digest.FromString(fmt.Sprintf("%s|%s|%s|%s|%s", parent, recipeDir, recipeName, tag, strings.Join(env, ","))))
+}
+
+// Entry is everything needed to reconstruct an image from a cached layer
+// without re-running a recipe's prepare/runrecipe/teardown phases.
+type Entry struct {
+	Layer   ocispec.Descriptor `json:"layer"`
+	DiffID  digest.Digest      `json:"diffID"`
+	History []ocispec.History  `json:"history"`
+}
+
+// EntryAnnotations renders key/entry as the manifest annotations a built
+// image should carry so the entry it represents can be recovered later via
+// Import, even from a registry that has never seen this daemon's local
+// CacheImageRef.
+func EntryAnnotations(key Key, entry Entry) (map[string]string, error) {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		annotationKey:   string(key),
+		annotationEntry: string(raw),
+	}, nil
+}
+
+// EntryFromAnnotations extracts the cache key/entry a manifest's
+// annotations were given by EntryAnnotations, if any.
+func EntryFromAnnotations(annotations map[string]string) (Key, *Entry, bool, error) {
+	rawKey, ok := annotations[annotationKey]
+	if !ok {
+		return "", nil, false, nil
+	}
+	rawEntry, ok := annotations[annotationEntry]
+	if !ok {
+		return "", nil, false, nil
+	}
+
+	var entry Entry
+	if err := json.Unmarshal([]byte(rawEntry), &entry); err != nil {
+		return "", nil, false, err
+	}
+
+	return Key(rawKey), &entry, true, nil
+}
+
+// Cache reads and writes build cache entries against CacheImageRef in a
+// containerd content/image store.
+type Cache struct {
+	client *containerd.Client
+}
+
+// New creates a Cache backed by client's content and image stores.
+func New(client *containerd.Client) *Cache {
+	return &Cache{client: client}
+}
+
+// Lookup returns the cached entry for key, if one exists.
+func (c *Cache) Lookup(ctx context.Context, key Key) (*Entry, bool, error) {
+	img, err := c.client.ImageService().Get(ctx, CacheImageRef)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	raw, ok := img.Labels[labelPrefix+string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var entry Entry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return nil, false, err
+	}
+
+	return &entry, true, nil
+}
+
+// Store records entry under key, creating CacheImageRef if it doesn't exist
+// yet. The layer and diff blobs referenced by entry must already be in the
+// content store; we tag their digests with containerd.io/gc.ref.content.*
+// labels so the garbage collector keeps them alive even though no image
+// manifest points at them directly.
+func (c *Cache) Store(ctx context.Context, key Key, entry Entry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	img, err := c.client.ImageService().Get(ctx, CacheImageRef)
+	isNew := false
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			return err
+		}
+		isNew = true
+		target, err := writePlaceholderManifest(ctx, c.client.ContentStore())
+		if err != nil {
+			return err
+		}
+		img = images.Image{Name: CacheImageRef, Target: target}
+	}
+
+	if img.Labels == nil {
+		img.Labels = map[string]string{}
+	}
+	img.Labels[labelPrefix+string(key)] = string(raw)
+	img.Labels["containerd.io/gc.ref.content."+string(key)] = entry.Layer.Digest.String()
+
+	if isNew {
+		_, err = c.client.ImageService().Create(ctx, img)
+	} else {
+		_, err = c.client.ImageService().Update(ctx, img)
+	}
+	return err
+}
+
+// writePlaceholderManifest writes an empty OCI manifest to the content
+// store and returns its descriptor, so CacheImageRef can be created with a
+// Target that actually resolves. We never read this manifest back; it only
+// exists because ImageService().Create validates Target.Digest, and all of
+// the real cache data lives on the image's labels instead.
+func writePlaceholderManifest(ctx context.Context, contentStore content.Store) (ocispec.Descriptor, error) {
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(nil), Size: 0},
+	}
+
+	p, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	dgst := digest.FromBytes(p)
+	if err := content.WriteBlob(ctx, contentStore, CacheImageRef+"-manifest", bytes.NewReader(p), int64(len(p)), dgst); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    dgst,
+		Size:      int64(len(p)),
+	}, nil
+}
+
+// Import fetches ref's manifest directly from its registry via resolver -
+// it does not need to already be pulled locally - and, if the manifest
+// carries a cache entry in its annotations (see EntryAnnotations), fetches
+// the layer blob that entry points at and stores the entry in the local
+// cache. This is what lets `--cache-from` reuse a layer a CI pipeline
+// already pushed, on a host that never built it itself; copying local
+// image labels (as containerd images carry them) wouldn't work, since
+// labels never travel with a pushed image.
+func (c *Cache) Import(ctx context.Context, resolver remotes.Resolver, ref string) error {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := fetchManifest(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+
+	key, entry, found, err := EntryFromAnnotations(manifest.Annotations)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	if err := fetchBlobInto(ctx, c.client.ContentStore(), fetcher, entry.Layer); err != nil {
+		return err
+	}
+
+	return c.Store(ctx, key, *entry)
+}
+
+// fetchManifest fetches and decodes the OCI manifest at desc using fetcher.
+func fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+	defer rc.Close()
+
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return ocispec.Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// fetchBlobInto copies desc from the registry (via fetcher) into store, so
+// a later cache hit can read it straight out of the local content store.
+// It's a no-op if the blob is already present.
+func fetchBlobInto(ctx context.Context, store content.Store, fetcher remotes.Fetcher, desc ocispec.Descriptor) error {
+	if _, err := store.Info(ctx, desc.Digest); err == nil {
+		return nil
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return content.WriteBlob(ctx, store, desc.Digest.String(), rc, desc.Size, desc.Digest)
+}
+
+// HashRecipeDir computes a deterministic content hash of a recipe
+// directory, used as part of the build cache key so entries invalidate
+// whenever the recipe's own files change.
+func HashRecipeDir(dir string) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	hash := digester.Hash()
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return digester.Digest(), nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"runtime"
+	"time"
 
 	"github.com/opencontainers/image-spec/identity"
 
@@ -14,11 +15,14 @@ import (
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
 	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pauldotknopf/darch/pkg/buildcache"
 	"github.com/pauldotknopf/darch/pkg/recipes"
 	"github.com/pauldotknopf/darch/pkg/reference"
 	"github.com/pauldotknopf/darch/pkg/utils"
@@ -27,8 +31,39 @@ import (
 
 const containerdUncompressed = "containerd.io/uncompressed"
 
-// BuildRecipe Builds a recipe.
-func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe, tag string, imagePrefix string, env []string) (reference.ImageRef, error) {
+// scratchInherits is the sentinel `inherits` value that lets a recipe build
+// `FROM scratch`, i.e. from an empty rootfs rather than an existing image.
+const scratchInherits = "scratch"
+
+// scratchParentDigest stands in for a parent image digest in the build
+// cache key when there is no parent image (a `FROM scratch` build).
+var scratchParentDigest = digest.FromString("scratch")
+
+// BuildOptions groups the build-only knobs BuildRecipe has picked up on
+// top of a recipe/tag/imagePrefix/env: attribution for the history entries
+// it records, and control over the build cache and layer-per-phase builds.
+// Keeping them in a struct avoids growing BuildRecipe's positional
+// parameter list every time one of these is extended, which invites
+// call-site transposition bugs (e.g. swapping two adjacent bools).
+type BuildOptions struct {
+	// Author/Comment attribute the history entries BuildRecipe records.
+	Author  string
+	Comment string
+	// NoCache skips the build cache entirely (neither reads nor writes it).
+	NoCache bool
+	// CacheFrom, if non-empty, imports cache entries embedded in a remote
+	// image's manifest annotations before looking up a cache hit.
+	CacheFrom string
+	// LayerPerPhase commits a separate image layer after each of the
+	// prepare/runrecipe/teardown phases instead of squashing them into
+	// one, for better layer reuse, pull caching, and debuggability. It's
+	// incompatible with the build cache (see NoCache/CacheFrom above),
+	// since a cached entry only ever records a single squashed layer.
+	LayerPerPhase bool
+}
+
+// BuildRecipe builds a recipe.
+func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe, tag string, imagePrefix string, env []string, opts BuildOptions) (reference.ImageRef, error) {
 
 	ctx = namespaces.WithNamespace(ctx, "darch")
 
@@ -41,29 +76,65 @@ func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe,
 		return reference.ImageRef{}, err
 	}
 
-	// Use the image prefix when inheriting local recipes.
-	// External references are expected to be fully qualified.
-	inherits := recipe.Inherits
-	if !recipe.InheritsExternal {
-		fmt.Printf("Not going external: %s\n", inherits)
-		inherits = imagePrefix + inherits
-		fmt.Println("--" + inherits)
-	}
-
-	// NOTE: We use ParseImageWithDefaultTag here.
-	// This allows recipes to use specific tags, but when
-	// they aren't, it uses the tag the we are building
-	// the recipe with.
-	// This allows use to "darch build -t custom-tag base base-common"
-	// and each built image will use the appropriate inherited image.
-	inheritsRef, err := reference.ParseImageWithDefaultTag(inherits, newImage.Tag)
+	// A nil img means we're building `FROM scratch`: there is no parent
+	// image to inherit from, so we skip resolving one entirely.
+	var img containerd.Image
+	fromScratch := recipe.Inherits == scratchInherits
+
+	if !fromScratch {
+		// Use the image prefix when inheriting local recipes.
+		// External references are expected to be fully qualified.
+		inherits := recipe.Inherits
+		if !recipe.InheritsExternal {
+			fmt.Printf("Not going external: %s\n", inherits)
+			inherits = imagePrefix + inherits
+			fmt.Println("--" + inherits)
+		}
+
+		// NOTE: We use ParseImageWithDefaultTag here.
+		// This allows recipes to use specific tags, but when
+		// they aren't, it uses the tag the we are building
+		// the recipe with.
+		// This allows use to "darch build -t custom-tag base base-common"
+		// and each built image will use the appropriate inherited image.
+		inheritsRef, err := reference.ParseImageWithDefaultTag(inherits, newImage.Tag)
+		if err != nil {
+			return newImage, err
+		}
+
+		img, err = session.client.GetImage(ctx, inheritsRef.FullName())
+		if err != nil {
+			return newImage, err
+		}
+	}
+
+	parentDigest := scratchParentDigest
+	if img != nil {
+		parentDigest = img.Target().Digest
+	}
+	recipeDirHash, err := buildcache.HashRecipeDir(recipe.RecipesDir)
 	if err != nil {
 		return newImage, err
 	}
+	cacheKey := buildcache.ComputeKey(parentDigest, recipeDirHash, recipe.Name, newImage.Tag, env)
+	cache := buildcache.New(session.client)
 
-	img, err := session.client.GetImage(ctx, inheritsRef.FullName())
-	if err != nil {
-		return newImage, err
+	if opts.CacheFrom != "" && !opts.NoCache {
+		resolver, err := newResolver(PushOptions{})
+		if err != nil {
+			return newImage, err
+		}
+		if err := cache.Import(ctx, resolver, opts.CacheFrom); err != nil {
+			return newImage, err
+		}
+	}
+
+	if !opts.NoCache && !opts.LayerPerPhase {
+		if entry, found, err := cache.Lookup(ctx, cacheKey); err != nil {
+			return newImage, err
+		} else if found {
+			return newImage, session.createImageFromCachedLayer(ctx, img, *entry, newImage)
+		}
 	}
 
 	ws, err := workspace.NewWorkspace("/tmp")
@@ -81,69 +152,136 @@ func (session *Session) BuildRecipe(ctx context.Context, recipe recipes.Recipe,
 		Options:     []string{"rbind", "ro"},
 	})
 
-	// Let's create the snapshot that all of our containers will run off of
+	// Let's create the snapshot that all of our containers will run off of.
+	// When building `FROM scratch`, there's no parent image, so the snapshot
+	// has no parent either.
 	snapshotKey := utils.NewID()
-	err = session.createSnapshot(ctx, snapshotKey, img)
+	if fromScratch {
+		err = session.createEmptySnapshot(ctx, snapshotKey)
+	} else {
+		err = session.createSnapshot(ctx, snapshotKey, img)
+	}
 	if err != nil {
 		return newImage, err
 	}
 	defer session.deleteSnapshot(ctx, snapshotKey)
 
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", "/darch-prepare"),
-			),
+	// When there's no parent image, we can't pull a base spec/config from it,
+	// so we fall back to containerd's own default spec.
+	containerOpts, specOpts := imageContainerOpts(img)
+
+	phases := []recipePhase{
+		{name: "prepare", args: []string{"/usr/bin/env", "bash", "-c", "/darch-prepare"}},
+		{name: "runrecipe", args: []string{"/usr/bin/env", "bash", "-c", fmt.Sprintf("/darch-runrecipe %s", recipe.Name)}},
+		{name: "teardown", args: []string{"/usr/bin/env", "bash", "-c", "/darch-teardown"}},
+	}
+	createdBy := fmt.Sprintf("darch build %s", recipe.Name)
+
+	if opts.LayerPerPhase {
+		// Hold one lease across both the per-phase diffs and the final
+		// manifest write, so the intermediate layer blobs can't be garbage
+		// collected in between.
+		ctx, done, err := session.client.WithLease(ctx)
+		if err != nil {
+			return newImage, err
+		}
+		defer done()
+
+		layers, diffIDs, history, err := session.buildRecipeLayered(ctx, phases, snapshotKey, containerOpts, specOpts, mounts, env, createdBy, opts.Author, opts.Comment)
+		if err != nil {
+			return newImage, err
+		}
+		return newImage, session.createImageFromLayers(ctx, img, layers, diffIDs, history, newImage)
+	}
+
+	for _, phase := range phases {
+		if err := session.runBuildContainer(ctx, containerOpts, specOpts, snapshotKey, env, mounts, phase.args); err != nil {
+			return newImage, err
+		}
+	}
+
+	now := time.Now()
+	history := []ocispec.History{
+		{
+			Created:    &now,
+			Author:     opts.Author,
+			CreatedBy:  createdBy + " (prepare)",
+			Comment:    opts.Comment,
+			EmptyLayer: true,
+		},
+		{
+			Created:   &now,
+			Author:    opts.Author,
+			CreatedBy: createdBy + " (runrecipe)",
+			Comment:   opts.Comment,
+		},
+		{
+			Created:    &now,
+			Author:     opts.Author,
+			CreatedBy:  createdBy + " (teardown)",
+			Comment:    opts.Comment,
+			EmptyLayer: true,
 		},
-	}); err != nil {
-		return newImage, err
 	}
 
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
-			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
-			containerd.WithSnapshot(snapshotKey),
-			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
-			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", fmt.Sprintf("/darch-runrecipe %s", recipe.Name)),
-			),
-		},
-	}); err != nil {
+	// Embedding the cache key in the published image's own manifest
+	// annotations (rather than only in the local CacheImageRef pseudo-image)
+	// is what lets a later `--cache-from` pull the entry back out of a
+	// registry, on a host that never built it itself.
+	annotateCacheKey := buildcache.Key("")
+	if !opts.NoCache {
+		annotateCacheKey = cacheKey
+	}
+
+	layer, diffID, err := session.createImageFromSnapshot(ctx, img, snapshotKey, containerd.DefaultSnapshotter, newImage, history, nil, annotateCacheKey)
+	if err != nil {
 		return newImage, err
 	}
 
-	if err = session.RunContainer(ctx, ContainerConfig{
-		newOpts: []containerd.NewContainerOpts{
-			containerd.WithImage(img),
+	if !opts.NoCache {
+		if err := cache.Store(ctx, cacheKey, buildcache.Entry{Layer: layer, DiffID: diffID, History: history}); err != nil {
+			return newImage, err
+		}
+	}
+
+	return newImage, nil
+}
+
+// recipePhase is one of the three build containers a recipe runs through:
+// prepare, runrecipe, and teardown.
+type recipePhase struct {
+	name string
+	args []string
+}
+
+// runBuildContainer runs a single recipe phase's container against
+// snapshotKey, reusing the image/spec options shared by every phase.
+func (session *Session) runBuildContainer(ctx context.Context, containerOpts []containerd.NewContainerOpts, specOpts []oci.SpecOpts, snapshotKey string, env []string, mounts []specs.Mount, args []string) error {
+	return session.RunContainer(ctx, ContainerConfig{
+		newOpts: append(append([]containerd.NewContainerOpts{}, containerOpts...),
 			containerd.WithSnapshotter(containerd.DefaultSnapshotter),
 			containerd.WithSnapshot(snapshotKey),
 			containerd.WithRuntime(fmt.Sprintf("io.containerd.runtime.v1.%s", runtime.GOOS), nil),
 			containerd.WithNewSpec(
-				oci.WithImageConfig(img),
-				oci.WithEnv(env),
-				oci.WithHostNamespace(specs.NetworkNamespace),
-				oci.WithMounts(mounts),
-				oci.WithProcessArgs("/usr/bin/env", "bash", "-c", "/darch-teardown"),
+				append(append([]oci.SpecOpts{}, specOpts...),
+					oci.WithEnv(env),
+					oci.WithHostNamespace(specs.NetworkNamespace),
+					oci.WithMounts(mounts),
+					oci.WithProcessArgs(args...),
+				)...,
 			),
-		},
-	}); err != nil {
-		return newImage, err
-	}
+		),
+	})
+}
 
-	return newImage, session.createImageFromSnapshot(ctx, img, snapshotKey, newImage)
+// imageContainerOpts builds the containerd/OCI options needed to run a
+// container off of img. When img is nil (building `FROM scratch`), there's
+// nothing to pull a spec or config from, so we fall back to the default spec.
+func imageContainerOpts(img containerd.Image) ([]containerd.NewContainerOpts, []oci.SpecOpts) {
+	if img == nil {
+		return nil, []oci.SpecOpts{oci.WithDefaultSpec()}
+	}
+	return []containerd.NewContainerOpts{containerd.WithImage(img)}, []oci.SpecOpts{oci.WithImageConfig(img)}
 }
 
 func (session *Session) createSnapshot(ctx context.Context, snapshotKey string, img containerd.Image) error {
@@ -158,11 +296,20 @@ func (session *Session) createSnapshot(ctx context.Context, snapshotKey string,
 	return nil
 }
 
+// createEmptySnapshot prepares a snapshot with no parent, used as the
+// starting rootfs for recipes that build `FROM scratch`.
+func (session *Session) createEmptySnapshot(ctx context.Context, snapshotKey string) error {
+	if _, err := session.client.SnapshotService(containerd.DefaultSnapshotter).Prepare(ctx, snapshotKey, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (session *Session) deleteSnapshot(ctx context.Context, snapshotKey string) error {
 	return session.client.SnapshotService(containerd.DefaultSnapshotter).Remove(ctx, snapshotKey)
 }
 
-func (session *Session) patchImageConfig(ctx context.Context, ref string, manifest *ocispec.Manifest, newLayerDigest digest.Digest) error {
+func (session *Session) patchImageConfig(ctx context.Context, ref string, manifest *ocispec.Manifest, newDiffIDs []digest.Digest, newHistory []ocispec.History, changes []string) error {
 	// Get the current image configuration.
 	p, err := content.ReadBlob(ctx, session.client.ContentStore(), manifest.Config.Digest)
 	if err != nil {
@@ -177,7 +324,7 @@ func (session *Session) patchImageConfig(ctx context.Context, ref string, manife
 		return err
 	}
 
-	// Pull the rootfs section out, so that we can append a layer to the diff_ids array.
+	// Pull the rootfs section out, so that we can append the new layer(s) to the diff_ids array.
 	var rootFS ocispec.RootFS
 	p, err = m["rootfs"].MarshalJSON()
 	if err != nil {
@@ -186,13 +333,48 @@ func (session *Session) patchImageConfig(ctx context.Context, ref string, manife
 	if err = json.Unmarshal(p, &rootFS); err != nil {
 		return err
 	}
-	rootFS.DiffIDs = append(rootFS.DiffIDs, newLayerDigest)
+	rootFS.DiffIDs = append(rootFS.DiffIDs, newDiffIDs...)
 	p, err = json.Marshal(rootFS)
 	if err != nil {
 		return err
 	}
 	m["rootfs"] = p
 
+	// Append the new history entries so `docker history`/`ctr` can show
+	// provenance for the layer(s) we just added. The number of non-empty
+	// entries must line up with the diff_ids we just appended above.
+	var history []ocispec.History
+	if raw, ok := m["history"]; ok {
+		if err = json.Unmarshal(raw, &history); err != nil {
+			return err
+		}
+	}
+	history = append(history, newHistory...)
+	p, err = json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	m["history"] = p
+
+	// Apply any Dockerfile-like directives (ENV, LABEL, CMD, ...) to the
+	// "config" section, same as `docker commit --change`.
+	if len(changes) > 0 {
+		var cfg ocispec.ImageConfig
+		if raw, ok := m["config"]; ok {
+			if err = json.Unmarshal(raw, &cfg); err != nil {
+				return err
+			}
+		}
+		if err = applyConfigChanges(&cfg, changes); err != nil {
+			return err
+		}
+		p, err = json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		m["config"] = p
+	}
+
 	// Convert our entire image configuration back to bytes, and write it to the content store.
 	p, err = json.Marshal(m)
 	if err != nil {
@@ -213,43 +395,113 @@ func (session *Session) patchImageConfig(ctx context.Context, ref string, manife
 	return err
 }
 
-func (session *Session) createImageFromSnapshot(ctx context.Context, img containerd.Image, activeSnapshotKey string, newImage reference.ImageRef) error {
-	ctx, done, err := session.client.WithLease(ctx) // Prevent garbage collection while we work.
+// writeScratchImageConfig writes a minimal image config for a `FROM scratch`
+// build - an empty rootfs on the current platform - and returns its digest
+// and size so it can be referenced from a manifest.
+func writeScratchImageConfig(ctx context.Context, contentStore content.Store) (digest.Digest, int64, error) {
+	now := time.Now()
+	cfg := ocispec.Image{
+		Created:      &now,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{},
+		},
+	}
+
+	p, err := json.Marshal(cfg)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
-	defer done()
 
+	dgst := digest.FromBytes(p)
+	if err := content.WriteBlob(ctx, contentStore, "scratch-config", bytes.NewReader(p), int64(len(p)), dgst); err != nil {
+		return "", 0, err
+	}
+
+	return dgst, int64(len(p)), nil
+}
+
+// baseManifest returns the manifest (and its media type) that a new image
+// should start from. For a normal build this is the parent image's own
+// manifest; for a `FROM scratch` build (img == nil) there is no parent, so
+// we construct a minimal OCI manifest/config from whole cloth.
+func (session *Session) baseManifest(ctx context.Context, img containerd.Image) (ocispec.Manifest, string, error) {
 	contentStore := session.client.ContentStore()
-	snapshotService := session.client.SnapshotService(containerd.DefaultSnapshotter)
-	imgTarget := img.Target()
 
-	// First, let's get the parent image digest, so that we can
-	// later create a new one from it, with a new layer added to it.
+	if img == nil {
+		configDigest, configSize, err := writeScratchImageConfig(ctx, contentStore)
+		if err != nil {
+			return ocispec.Manifest{}, "", err
+		}
+		manifest := ocispec.Manifest{
+			Versioned: ispec.Versioned{SchemaVersion: 2},
+			Config: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+		}
+		return manifest, ocispec.MediaTypeImageManifest, nil
+	}
+
+	imgTarget := img.Target()
 	p, err := content.ReadBlob(ctx, contentStore, imgTarget.Digest)
 	if err != nil {
-		return err
+		return ocispec.Manifest{}, "", err
 	}
 	var manifest ocispec.Manifest
 	if err := json.Unmarshal(p, &manifest); err != nil {
-		return err
+		return ocispec.Manifest{}, "", err
 	}
+	return manifest, imgTarget.MediaType, nil
+}
+
+// layerMediaTypeFor returns the layer media type that matches
+// manifestMediaType, since a manifest can only reference layers of the
+// corresponding schema (Docker or OCI).
+func layerMediaTypeFor(manifestMediaType string) (string, error) {
+	switch manifestMediaType {
+	case images.MediaTypeDockerSchema2Manifest:
+		return images.MediaTypeDockerSchema2LayerGzip, nil
+	case ocispec.MediaTypeImageManifest:
+		return ocispec.MediaTypeImageLayerGzip, nil
+	default:
+		return "", fmt.Errorf("unknown parent image manifest type: %s", manifestMediaType)
+	}
+}
+
+// diffActiveSnapshot diffs activeSnapshotKey against its parent (or against
+// nothing, for a `FROM scratch` snapshot with no parent) and returns the
+// resulting layer descriptor and its uncompressed diffID. snapshotter
+// identifies which snapshotter activeSnapshotKey lives in - it won't
+// necessarily be containerd.DefaultSnapshotter, e.g. when diffing a
+// container darch didn't create itself (see CommitContainer).
+func (session *Session) diffActiveSnapshot(ctx context.Context, activeSnapshotKey string, snapshotter string, layerMediaType string) (ocispec.Descriptor, digest.Digest, error) {
+	contentStore := session.client.ContentStore()
+	snapshotService := session.client.SnapshotService(snapshotter)
 
 	snapshot, err := snapshotService.Stat(ctx, activeSnapshotKey)
 	if err != nil {
-		return err
+		return ocispec.Descriptor{}, "", err
 	}
 
 	upperMounts, err := snapshotService.Mounts(ctx, activeSnapshotKey)
 	if err != nil {
-		return err
+		return ocispec.Descriptor{}, "", err
 	}
 
-	lowerMounts, err := snapshotService.View(ctx, "temp-readonly-parent", snapshot.Parent)
-	if err != nil {
-		return err
+	// A snapshot prepared with no parent (the `FROM scratch` case) has
+	// nothing to diff against, so we just leave lowerMounts empty.
+	var lowerMounts []mount.Mount
+	if snapshot.Parent != "" {
+		lowerMounts, err = snapshotService.View(ctx, "temp-readonly-parent", snapshot.Parent)
+		if err != nil {
+			return ocispec.Descriptor{}, "", err
+		}
+		defer snapshotService.Remove(ctx, "temp-readonly-parent")
 	}
-	defer snapshotService.Remove(ctx, "temp-readonly-parent")
 
 	// Generate a diff in content store
 	diffs, err := session.client.DiffService().DiffMounts(ctx,
@@ -258,39 +510,97 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 		diff.WithMediaType(ocispec.MediaTypeImageLayerGzip),
 		diff.WithReference("custom-ref"))
 	if err != nil {
-		return err
-	}
-
-	// These builds can be done on docker images, or OCI image.
-	// Let's make sure the new layer uses the same content type as the manifest expects.
-	switch imgTarget.MediaType {
-	case images.MediaTypeDockerSchema2Manifest:
-		diffs.MediaType = images.MediaTypeDockerSchema2LayerGzip
-		break
-	case ocispec.MediaTypeImageManifest:
-		diffs.MediaType = ocispec.MediaTypeImageLayerGzip
-		break
-	default:
-		return fmt.Errorf("unknown parent image manifest type: %s", imgTarget.MediaType)
+		return ocispec.Descriptor{}, "", err
 	}
-
-	// Add our new layer to the image manifest
-	manifest.Layers = append(manifest.Layers, diffs)
+	diffs.MediaType = layerMediaType
 
 	// Add the blob checksum to image config
 	info, err := contentStore.Info(ctx, diffs.Digest)
 	if err != nil {
-		return err
+		return ocispec.Descriptor{}, "", err
 	}
 	diffIDStr, ok := info.Labels[containerdUncompressed]
 	if !ok {
-		return fmt.Errorf("invalid differ response with no diffID")
+		return ocispec.Descriptor{}, "", fmt.Errorf("invalid differ response with no diffID")
 	}
 	diffIDDigest, err := digest.Parse(diffIDStr)
 	if err != nil {
-		return err
+		return ocispec.Descriptor{}, "", err
 	}
-	err = session.patchImageConfig(ctx, "custom-ref", &manifest, diffIDDigest)
+
+	return diffs, diffIDDigest, nil
+}
+
+// createImageFromSnapshot diffs activeSnapshotKey (which lives in
+// snapshotter) against its parent, appends the resulting layer (and
+// history) to img's manifest, and publishes the result as newImage.
+// changes, if non-empty, applies Dockerfile-like directives to the image
+// config (see CommitOptions). cacheKey, if non-empty, is embedded in the
+// published manifest's annotations (see buildcache.EntryAnnotations) so a
+// later `--cache-from` can recover this build's cache entry from the
+// registry. It returns the descriptor and diffID of the layer it created,
+// so callers can cache it for future builds.
+func (session *Session) createImageFromSnapshot(ctx context.Context, img containerd.Image, activeSnapshotKey string, snapshotter string, newImage reference.ImageRef, history []ocispec.History, changes []string, cacheKey buildcache.Key) (ocispec.Descriptor, digest.Digest, error) {
+	ctx, done, err := session.client.WithLease(ctx) // Prevent garbage collection while we work.
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer done()
+
+	manifest, manifestMediaType, err := session.baseManifest(ctx, img)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	layerMediaType, err := layerMediaTypeFor(manifestMediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	diffs, diffIDDigest, err := session.diffActiveSnapshot(ctx, activeSnapshotKey, snapshotter, layerMediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	var annotations map[string]string
+	if cacheKey != "" {
+		annotations, err = buildcache.EntryAnnotations(cacheKey, buildcache.Entry{Layer: diffs, DiffID: diffIDDigest, History: history})
+		if err != nil {
+			return ocispec.Descriptor{}, "", err
+		}
+	}
+
+	if err := session.finalizeImage(ctx, manifest, manifestMediaType, []ocispec.Descriptor{diffs}, []digest.Digest{diffIDDigest}, history, changes, annotations, newImage); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	return diffs, diffIDDigest, nil
+}
+
+// finalizeImage appends layers/diffIDs/history to manifest, writes the
+// resulting manifest and patched config to the content store, and
+// publishes newImage pointing at it. It's shared by every path that
+// produces a darch image: a single-layer build (createImageFromSnapshot), a
+// build-cache hit (createImageFromCachedLayer), and a layer-per-phase build
+// (createImageFromLayers) - they differ only in how many layers they have
+// and where those layers came from. annotations, if non-empty, are merged
+// into the manifest's own annotations (see buildcache.EntryAnnotations).
+func (session *Session) finalizeImage(ctx context.Context, manifest ocispec.Manifest, manifestMediaType string, layers []ocispec.Descriptor, diffIDs []digest.Digest, history []ocispec.History, changes []string, annotations map[string]string, newImage reference.ImageRef) error {
+	contentStore := session.client.ContentStore()
+
+	// Add our new layer(s) to the image manifest
+	manifest.Layers = append(manifest.Layers, layers...)
+
+	if len(annotations) > 0 {
+		if manifest.Annotations == nil {
+			manifest.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			manifest.Annotations[k] = v
+		}
+	}
+
+	err := session.patchImageConfig(ctx, "custom-ref", &manifest, diffIDs, history, changes)
 	if err != nil {
 		return err
 	}
@@ -300,8 +610,8 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 	labels := map[string]string{
 		"containerd.io/gc.ref.content.0": manifest.Config.Digest.String(),
 	}
-	for i, layer := range manifest.Layers {
-		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = layer.Digest.String()
+	for i, l := range manifest.Layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = l.Digest.String()
 	}
 
 	// Save our new image manifest, which now hows our new layer,
@@ -333,7 +643,7 @@ func (session *Session) createImageFromSnapshot(ctx context.Context, img contain
 			Target: ocispec.Descriptor{
 				Digest:    manifestDigest,
 				Size:      int64(len(manifestBytes)),
-				MediaType: imgTarget.MediaType, /*use same one as inherited image*/
+				MediaType: manifestMediaType, /*use same one as inherited image, or OCI when built from scratch*/
 			},
 		})
 	if err != nil {
@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/containerd/containerd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pauldotknopf/darch/pkg/buildcache"
+	"github.com/pauldotknopf/darch/pkg/reference"
+)
+
+// createImageFromCachedLayer publishes newImage by appending a previously
+// built layer (entry) to img's manifest, without re-running any of the
+// recipe's build containers. It mirrors createImageFromSnapshot, except the
+// layer/diffID/history come from the build cache instead of a fresh diff.
+func (session *Session) createImageFromCachedLayer(ctx context.Context, img containerd.Image, entry buildcache.Entry, newImage reference.ImageRef) error {
+	ctx, done, err := session.client.WithLease(ctx) // Prevent garbage collection while we work.
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	manifest, manifestMediaType, err := session.baseManifest(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	return session.finalizeImage(ctx, manifest, manifestMediaType, []ocispec.Descriptor{entry.Layer}, []digest.Digest{entry.DiffID}, entry.History, nil, nil, newImage)
+}
@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pauldotknopf/darch/pkg/reference"
+)
+
+// CommitOptions configures Session.CommitContainer.
+type CommitOptions struct {
+	// Author attributes the resulting history entry.
+	Author string
+	// Comment annotates the resulting history entry.
+	Comment string
+	// Changes applies Dockerfile-like directives (ENV, LABEL, CMD,
+	// ENTRYPOINT, WORKDIR, EXPOSE, USER, VOLUME) to the image config before
+	// it's committed, the same way `docker commit --change` does.
+	Changes []string
+	// Pause pauses the container's running task (containerd task
+	// Pause/Resume) before the diff, so the resulting layer reflects a
+	// consistent snapshot, and resumes it once the commit is done. A
+	// container with no running task is committed without pausing.
+	Pause bool
+}
+
+// CommitContainer snapshots a container's current state into a new image,
+// the way `docker commit` does. It reuses the same layer-diff/manifest
+// patching flow as BuildRecipe, so recipe-built and interactively-committed
+// images stay consistent with one another.
+func (session *Session) CommitContainer(ctx context.Context, containerID string, newImage reference.ImageRef, opts CommitOptions) (reference.ImageRef, error) {
+	ctx = namespaces.WithNamespace(ctx, "darch")
+
+	container, err := session.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return newImage, err
+	}
+
+	info, err := container.Info(ctx)
+	if err != nil {
+		return newImage, err
+	}
+
+	img, err := session.client.GetImage(ctx, info.Image)
+	if err != nil {
+		return newImage, err
+	}
+
+	if opts.Pause {
+		if task, err := container.Task(ctx, nil); err == nil {
+			if err := task.Pause(ctx); err != nil {
+				return newImage, err
+			}
+			defer task.Resume(ctx)
+		}
+	}
+
+	now := time.Now()
+	history := []ocispec.History{
+		{
+			Created:   &now,
+			Author:    opts.Author,
+			CreatedBy: fmt.Sprintf("darch commit %s", containerID),
+			Comment:   opts.Comment,
+		},
+	}
+
+	_, _, err = session.createImageFromSnapshot(ctx, img, info.SnapshotKey, info.Snapshotter, newImage, history, opts.Changes, "")
+	return newImage, err
+}
+
+// applyConfigChanges mutates cfg according to Dockerfile-like directives,
+// one per entry in changes (e.g. "ENV FOO=bar", `CMD ["/bin/sh"]`).
+func applyConfigChanges(cfg *ocispec.ImageConfig, changes []string) error {
+	for _, change := range changes {
+		parts := strings.SplitN(strings.TrimSpace(change), " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid change directive: %q", change)
+		}
+		directive, value := parts[0], strings.TrimSpace(parts[1])
+
+		switch strings.ToUpper(directive) {
+		case "ENV":
+			// Replace an existing value for the same variable rather than
+			// adding a second entry for it.
+			name := strings.SplitN(value, "=", 2)[0] + "="
+			replaced := false
+			for i, e := range cfg.Env {
+				if strings.HasPrefix(e, name) {
+					cfg.Env[i] = value
+					replaced = true
+				}
+			}
+			if !replaced {
+				cfg.Env = append(cfg.Env, value)
+			}
+		case "LABEL":
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid LABEL change: %q", value)
+			}
+			if cfg.Labels == nil {
+				cfg.Labels = map[string]string{}
+			}
+			cfg.Labels[kv[0]] = strings.Trim(kv[1], `"`)
+		case "CMD":
+			cmd, err := parseExecForm(value)
+			if err != nil {
+				return fmt.Errorf("invalid CMD change: %w", err)
+			}
+			cfg.Cmd = cmd
+		case "ENTRYPOINT":
+			entrypoint, err := parseExecForm(value)
+			if err != nil {
+				return fmt.Errorf("invalid ENTRYPOINT change: %w", err)
+			}
+			cfg.Entrypoint = entrypoint
+		case "WORKDIR":
+			cfg.WorkingDir = value
+		case "EXPOSE":
+			if cfg.ExposedPorts == nil {
+				cfg.ExposedPorts = map[string]struct{}{}
+			}
+			cfg.ExposedPorts[value] = struct{}{}
+		case "USER":
+			cfg.User = value
+		case "VOLUME":
+			if cfg.Volumes == nil {
+				cfg.Volumes = map[string]struct{}{}
+			}
+			cfg.Volumes[value] = struct{}{}
+		default:
+			return fmt.Errorf("unsupported change directive: %s", directive)
+		}
+	}
+	return nil
+}
+
+// parseExecForm parses a CMD/ENTRYPOINT value, accepting either exec form
+// (a JSON array, e.g. `["/bin/sh", "-c", "echo hi"]`) or shell form (a bare
+// string, wrapped in `/bin/sh -c`).
+func parseExecForm(value string) ([]string, error) {
+	if strings.HasPrefix(value, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(value), &args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+	return []string{"/bin/sh", "-c", value}, nil
+}
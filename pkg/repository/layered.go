@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/oci"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/pauldotknopf/darch/pkg/reference"
+	"github.com/pauldotknopf/darch/pkg/utils"
+)
+
+// emptyLayerDiffID is the diffID of an empty (uncompressed) tar archive.
+// It's the same well-known value moby and containerd use to recognize a
+// diff that didn't actually change anything.
+const emptyLayerDiffID = digest.Digest("sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef")
+
+// buildRecipeLayered runs each recipe phase and commits a layer in between,
+// instead of squashing all three phases into one. Phases that leave the
+// rootfs untouched don't get a layer, but still get an empty_layer history
+// entry, so the non-empty history entries stay aligned one-to-one with the
+// diff_ids.
+func (session *Session) buildRecipeLayered(ctx context.Context, phases []recipePhase, snapshotKey string, containerOpts []containerd.NewContainerOpts, specOpts []oci.SpecOpts, mounts []specs.Mount, env []string, createdBy string, author string, comment string) ([]ocispec.Descriptor, []digest.Digest, []ocispec.History, error) {
+	ctx, done, err := session.client.WithLease(ctx) // Reuses the caller's lease, if any, which keeps intermediate layers alive until the final manifest references them.
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer done()
+
+	var layers []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	var history []ocispec.History
+
+	// Every committed-intermediate and final-active snapshot created below
+	// only exists to let us diff one phase at a time; once the layers are
+	// extracted into the content store, none of them are needed anymore.
+	// Clean them up on every return path, success or failure, in reverse
+	// (child-before-parent) order.
+	var createdSnapshots []string
+	defer func() {
+		for i := len(createdSnapshots) - 1; i >= 0; i-- {
+			session.deleteSnapshot(ctx, createdSnapshots[i])
+		}
+	}()
+
+	for _, phase := range phases {
+		if err := session.runBuildContainer(ctx, containerOpts, specOpts, snapshotKey, env, mounts, phase.args); err != nil {
+			return nil, nil, nil, err
+		}
+
+		layer, diffID, empty, err := session.commitActiveSnapshot(ctx, &snapshotKey, &createdSnapshots)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		now := time.Now()
+		entry := ocispec.History{
+			Created:   &now,
+			Author:    author,
+			CreatedBy: fmt.Sprintf("%s (%s)", createdBy, phase.name),
+			Comment:   comment,
+		}
+		if empty {
+			entry.EmptyLayer = true
+		} else {
+			layers = append(layers, layer)
+			diffIDs = append(diffIDs, diffID)
+		}
+		history = append(history, entry)
+	}
+
+	return layers, diffIDs, history, nil
+}
+
+// commitActiveSnapshot diffs *activeSnapshotKey against its parent. If the
+// phase produced no changes, it leaves the snapshot as-is and reports
+// empty=true. Otherwise it commits the snapshot into a layer and prepares a
+// new active snapshot on top of it, so the next phase builds on top of this
+// one instead of inside it. Every snapshot key it creates (the commit and
+// the new active snapshot) is appended to *createdSnapshots so the caller
+// can clean them up once the build is done.
+func (session *Session) commitActiveSnapshot(ctx context.Context, activeSnapshotKey *string, createdSnapshots *[]string) (layer ocispec.Descriptor, diffID digest.Digest, empty bool, err error) {
+	snapshotService := session.client.SnapshotService(containerd.DefaultSnapshotter)
+
+	layer, diffID, err = session.diffActiveSnapshot(ctx, *activeSnapshotKey, containerd.DefaultSnapshotter, ocispec.MediaTypeImageLayerGzip)
+	if err != nil {
+		return ocispec.Descriptor{}, "", false, err
+	}
+
+	if diffID == emptyLayerDiffID {
+		return ocispec.Descriptor{}, "", true, nil
+	}
+
+	commitKey := utils.NewID()
+	if err := snapshotService.Commit(ctx, commitKey, *activeSnapshotKey); err != nil {
+		return ocispec.Descriptor{}, "", false, err
+	}
+	*createdSnapshots = append(*createdSnapshots, commitKey)
+
+	nextKey := utils.NewID()
+	if _, err := snapshotService.Prepare(ctx, nextKey, commitKey); err != nil {
+		return ocispec.Descriptor{}, "", false, err
+	}
+	*createdSnapshots = append(*createdSnapshots, nextKey)
+	*activeSnapshotKey = nextKey
+
+	return layer, diffID, false, nil
+}
+
+// createImageFromLayers publishes newImage from a set of already-diffed
+// layers (see buildRecipeLayered), instead of diffing a single combined
+// snapshot the way createImageFromSnapshot does.
+func (session *Session) createImageFromLayers(ctx context.Context, img containerd.Image, layers []ocispec.Descriptor, diffIDs []digest.Digest, history []ocispec.History, newImage reference.ImageRef) error {
+	ctx, done, err := session.client.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	manifest, manifestMediaType, err := session.baseManifest(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	// The layers were diffed as OCI gzip; relabel them to match the base
+	// manifest's schema, the same way createImageFromSnapshot does.
+	layerMediaType, err := layerMediaTypeFor(manifestMediaType)
+	if err != nil {
+		return err
+	}
+	for i := range layers {
+		layers[i].MediaType = layerMediaType
+	}
+
+	return session.finalizeImage(ctx, manifest, manifestMediaType, layers, diffIDs, history, nil, nil, newImage)
+}